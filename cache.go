@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os/user"
+	"sync"
+)
+
+// cachedUser and cachedGroup wrap user.LookupId/LookupGroupId with a
+// uid/gid-keyed cache, since the NSS lookups they perform can dominate
+// cost on large trees with many distinct owners and every Formatter calls
+// them once per entry.
+var (
+	userCacheMu sync.Mutex
+	userCache   = map[string]*user.User{}
+	groupCache  = map[string]*user.Group{}
+)
+
+func cachedUser(uid string) (*user.User, error) {
+	userCacheMu.Lock()
+	defer userCacheMu.Unlock()
+	if u, ok := userCache[uid]; ok {
+		return u, nil
+	}
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return nil, err
+	}
+	userCache[uid] = u
+	return u, nil
+}
+
+func cachedGroup(gid string) (*user.Group, error) {
+	userCacheMu.Lock()
+	defer userCacheMu.Unlock()
+	if g, ok := groupCache[gid]; ok {
+		return g, nil
+	}
+	g, err := user.LookupGroupId(gid)
+	if err != nil {
+		return nil, err
+	}
+	groupCache[gid] = g
+	return g, nil
+}
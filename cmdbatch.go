@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// cmdBatcher accumulates matched paths into groups of batchSize and runs
+// cmd once per group, up to workers groups at a time, mirroring xargs -L/-P.
+// Batching multiple paths into one invocation amortizes shell startup cost
+// on large trees.
+type cmdBatcher struct {
+	cmd     string
+	token   string
+	nul     bool
+	size    int
+	workers int
+
+	mu      sync.Mutex
+	pending []string
+	sem     chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newCmdBatcher(cmd, token string, nul bool, size, workers int) *cmdBatcher {
+	if size < 1 {
+		size = 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return &cmdBatcher{
+		cmd:     cmd,
+		token:   token,
+		nul:     nul,
+		size:    size,
+		workers: workers,
+		sem:     make(chan struct{}, workers),
+	}
+}
+
+// add appends path to the current batch, flushing (and running) it once it
+// reaches size. Safe for concurrent use by multiple walk goroutines.
+func (b *cmdBatcher) add(path string) {
+	b.mu.Lock()
+	b.pending = append(b.pending, path)
+	var batch []string
+	if len(b.pending) >= b.size {
+		batch, b.pending = b.pending, nil
+	}
+	b.mu.Unlock()
+	if batch != nil {
+		b.dispatch(batch)
+	}
+}
+
+// flush runs whatever is left in a partial batch; call once after the walk
+// that feeds add has finished.
+func (b *cmdBatcher) flush() {
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+	if len(batch) > 0 {
+		b.dispatch(batch)
+	}
+}
+
+func (b *cmdBatcher) dispatch(batch []string) {
+	b.sem <- struct{}{}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer func() { <-b.sem }()
+		if err := runCmd(b.cmd, batch, b.token, b.nul); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+	}()
+}
+
+func (b *cmdBatcher) wait() { b.wg.Wait() }
+
+// runCmd runs cmdline in a sub shell once for the given batch of paths.
+// Every occurrence of token not preceded by a backslash is replaced with a
+// single space-joined, shell-quoted argument list built from paths, so
+// filenames containing spaces, quotes or newlines can't break out of the
+// command (the previous implementation substituted % raw). If token does
+// not occur in cmdline, paths are instead written to the sub shell's
+// standard input, one per line (or NUL-terminated when nul is set), so
+// batched invocations can still consume every path via a pipeline such as
+// "! xargs -0 grep foo".
+func runCmd(cmdline string, paths []string, token string, nul bool) error {
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = shellQuote(p)
+	}
+	substituted, didSub := substituteToken(cmdline, token, strings.Join(quoted, " "))
+
+	c := exec.Command("/bin/sh", "-c", substituted)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if didSub {
+		c.Stdin = os.Stdin
+	} else {
+		sep := "\n"
+		if nul {
+			sep = "\x00"
+		}
+		c.Stdin = strings.NewReader(strings.Join(paths, sep) + sep)
+	}
+	return c.Run()
+}
+
+// substituteToken replaces every unescaped occurrence of token in cmdline
+// with value, returning whether any replacement happened. A token preceded
+// by a backslash is left in the output literally, matching the original
+// escaping rule for %.
+func substituteToken(cmdline, token, value string) (string, bool) {
+	if token == "" {
+		token = "%"
+	}
+	var sb strings.Builder
+	did := false
+	for i := 0; i < len(cmdline); {
+		if strings.HasPrefix(cmdline[i:], token) && !(i > 0 && cmdline[i-1] == '\\') {
+			sb.WriteString(value)
+			did = true
+			i += len(token)
+			continue
+		}
+		sb.WriteByte(cmdline[i])
+		i++
+	}
+	return sb.String(), did
+}
+
+// shellQuote wraps s in single quotes for /bin/sh, escaping any embedded
+// single quote as '\”; this is the standard POSIX technique for quoting an
+// arbitrary string and is safe for spaces, double quotes and newlines alike.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
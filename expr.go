@@ -0,0 +1,560 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// attr identifies a file attribute that can appear on either side of an
+// -expr comparison. The letters mirror the -e format characters; the long
+// names are accepted as friendlier aliases for the same attribute.
+type attr int
+
+const (
+	attrOwner attr = iota
+	attrGroup
+	attrModifier
+	attrATime
+	attrMTime
+	attrName
+	attrPath
+	attrSize
+	attrPerm
+	attrDepth
+	attrType
+)
+
+var attrNames = map[string]attr{
+	"U": attrOwner, "owner": attrOwner,
+	"G": attrGroup, "group": attrGroup,
+	"M": attrModifier, "modifier": attrModifier,
+	"a": attrATime, "atime": attrATime,
+	"m": attrMTime, "mtime": attrMTime,
+	"n": attrName, "name": attrName,
+	"p": attrPath, "path": attrPath,
+	"s": attrSize, "size": attrSize,
+	"x": attrPerm, "perm": attrPerm,
+	"depth": attrDepth,
+	"type":  attrType,
+}
+
+// exprCtx carries the per-entry values an -expr expression is evaluated
+// against.
+type exprCtx struct {
+	path  string
+	fi    fs.FileInfo
+	depth int
+}
+
+// exprNode is a node of the -expr AST. Comparisons and the boolean
+// combinators &&, ||, ! all implement it.
+type exprNode interface {
+	eval(ctx *exprCtx) (bool, error)
+}
+
+type andNode struct{ left, right exprNode }
+
+func (n *andNode) eval(ctx *exprCtx) (bool, error) {
+	l, err := n.left.eval(ctx)
+	if err != nil || !l {
+		return false, err
+	}
+	return n.right.eval(ctx)
+}
+
+type orNode struct{ left, right exprNode }
+
+func (n *orNode) eval(ctx *exprCtx) (bool, error) {
+	l, err := n.left.eval(ctx)
+	if err != nil || l {
+		return l, err
+	}
+	return n.right.eval(ctx)
+}
+
+type notNode struct{ operand exprNode }
+
+func (n *notNode) eval(ctx *exprCtx) (bool, error) {
+	v, err := n.operand.eval(ctx)
+	return !v, err
+}
+
+// cmpNode compares a value expression against another using op.
+type cmpNode struct {
+	op          string
+	left, right valueNode
+}
+
+func (n *cmpNode) eval(ctx *exprCtx) (bool, error) {
+	l, err := n.left.value(ctx)
+	if err != nil {
+		return false, err
+	}
+	r, err := n.right.value(ctx)
+	if err != nil {
+		return false, err
+	}
+	return compareValues(n.op, l, r)
+}
+
+// valueNode produces a scalar value (string, int64, bool or time.Time) used
+// inside a comparison.
+type valueNode interface {
+	value(ctx *exprCtx) (interface{}, error)
+}
+
+type identNode struct{ a attr }
+
+func (n *identNode) value(ctx *exprCtx) (interface{}, error) {
+	switch n.a {
+	case attrOwner, attrGroup, attrModifier, attrATime:
+		return statAttr(n.a, ctx.fi)
+	case attrMTime:
+		return ctx.fi.ModTime(), nil
+	case attrName:
+		return ctx.fi.Name(), nil
+	case attrPath:
+		return ctx.path, nil
+	case attrSize:
+		return ctx.fi.Size(), nil
+	case attrPerm:
+		return int64(ctx.fi.Mode().Perm()), nil
+	case attrDepth:
+		return int64(ctx.depth), nil
+	case attrType:
+		return typeChar(ctx.fi), nil
+	}
+	return nil, fmt.Errorf("unknown attribute")
+}
+
+type litNode struct{ v interface{} }
+
+func (n *litNode) value(ctx *exprCtx) (interface{}, error) { return n.v, nil }
+
+// bitandNode implements the `&` bitwise-and operator, e.g. perm&0111.
+type bitandNode struct{ left, right valueNode }
+
+func (n *bitandNode) value(ctx *exprCtx) (interface{}, error) {
+	l, err := n.left.value(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.right.value(ctx)
+	if err != nil {
+		return nil, err
+	}
+	li, ok := l.(int64)
+	if !ok {
+		return nil, fmt.Errorf("& requires numeric operands")
+	}
+	ri, ok := r.(int64)
+	if !ok {
+		return nil, fmt.Errorf("& requires numeric operands")
+	}
+	return li & ri, nil
+}
+
+func compareValues(op string, l, r interface{}) (bool, error) {
+	switch lv := l.(type) {
+	case int64:
+		rv, ok := r.(int64)
+		if !ok {
+			return false, fmt.Errorf("type mismatch in %s comparison", op)
+		}
+		switch op {
+		case "==":
+			return lv == rv, nil
+		case "!=":
+			return lv != rv, nil
+		case "<":
+			return lv < rv, nil
+		case "<=":
+			return lv <= rv, nil
+		case ">":
+			return lv > rv, nil
+		case ">=":
+			return lv >= rv, nil
+		}
+	case time.Time:
+		rv, ok := r.(time.Time)
+		if !ok {
+			return false, fmt.Errorf("type mismatch in %s comparison", op)
+		}
+		switch op {
+		case "==":
+			return lv.Equal(rv), nil
+		case "!=":
+			return !lv.Equal(rv), nil
+		case "<":
+			return lv.Before(rv), nil
+		case "<=":
+			return lv.Before(rv) || lv.Equal(rv), nil
+		case ">":
+			return lv.After(rv), nil
+		case ">=":
+			return lv.After(rv) || lv.Equal(rv), nil
+		}
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return false, fmt.Errorf("type mismatch in %s comparison", op)
+		}
+		switch op {
+		case "==":
+			return lv == rv, nil
+		case "!=":
+			return lv != rv, nil
+		case "=~":
+			re, err := regexp.Compile(rv)
+			if err != nil {
+				return false, err
+			}
+			return re.MatchString(lv), nil
+		case "glob":
+			return filepath.Match(rv, lv)
+		}
+	}
+	return false, fmt.Errorf("unsupported comparison %s", op)
+}
+
+// statAttr resolves the owner/group/modifier/atime attributes that require
+// a syscall.Stat_t, mirroring the U/G/M/a format characters in printPath.
+func statAttr(a attr, fi fs.FileInfo) (interface{}, error) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, fmt.Errorf("attribute unavailable on this platform")
+	}
+	switch a {
+	case attrOwner:
+		u, err := user.LookupId(fmt.Sprint(stat.Uid))
+		if err != nil {
+			return nil, err
+		}
+		return u.Username, nil
+	case attrGroup:
+		u, err := user.LookupId(fmt.Sprint(stat.Uid))
+		if err != nil {
+			return nil, err
+		}
+		g, err := user.LookupGroupId(u.Gid)
+		if err != nil {
+			return nil, err
+		}
+		return g.Name, nil
+	case attrModifier:
+		u, err := user.LookupId(fmt.Sprint(stat.Uid))
+		if err != nil {
+			return nil, err
+		}
+		return u.Name, nil
+	case attrATime:
+		return time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec)), nil
+	}
+	return nil, fmt.Errorf("unsupported stat attribute")
+}
+
+// typeChar reports the type character used by the `type` expr attribute
+// and the `t` -e format character.
+func typeChar(fi fs.FileInfo) string {
+	switch {
+	case fi.Mode()&fs.ModeSymlink != 0:
+		return "l"
+	case fi.IsDir():
+		return "d"
+	case fi.Mode()&fs.ModeNamedPipe != 0:
+		return "p"
+	case fi.Mode()&fs.ModeSocket != 0:
+		return "s"
+	case fi.Mode()&fs.ModeDevice != 0:
+		if fi.Mode()&fs.ModeCharDevice != 0 {
+			return "c"
+		}
+		return "b"
+	default:
+		return "f"
+	}
+}
+
+// parseExpr compiles an -expr string into an exprNode.
+func parseExpr(s string) (exprNode, error) {
+	p := &exprParser{toks: tokenizeExpr(s)}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, fmt.Errorf("unexpected token %q", p.toks[p.pos].text)
+	}
+	return n, nil
+}
+
+type exprToken struct {
+	kind string // "ident", "num", "str", "op"
+	text string
+}
+
+func tokenizeExpr(s string) []exprToken {
+	var toks []exprToken
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '"':
+			j := i + 1
+			var sb strings.Builder
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				sb.WriteByte(s[j])
+				j++
+			}
+			toks = append(toks, exprToken{"str", sb.String()})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'x' || (s[j] >= 'a' && s[j] <= 'f')) {
+				j++
+			}
+			toks = append(toks, exprToken{"num", s[i:j]})
+			i = j
+		case isIdentStart(c):
+			j := i
+			for j < len(s) && isIdentPart(s[j]) {
+				j++
+			}
+			toks = append(toks, exprToken{"ident", s[i:j]})
+			i = j
+		default:
+			two := ""
+			if i+1 < len(s) {
+				two = s[i : i+2]
+			}
+			switch two {
+			case "&&", "||", "==", "!=", ">=", "<=", "=~":
+				toks = append(toks, exprToken{"op", two})
+				i += 2
+				continue
+			}
+			toks = append(toks, exprToken{"op", string(c)})
+			i++
+		}
+	}
+	return toks
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+type exprParser struct {
+	toks []exprToken
+	pos  int
+}
+
+func (p *exprParser) peek() exprToken {
+	if p.pos >= len(p.toks) {
+		return exprToken{}
+	}
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "op" && p.peek().text == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "op" && p.peek().text == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peek().kind == "op" && p.peek().text == "!" {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand}, nil
+	}
+	if p.peek().kind == "op" && p.peek().text == "(" {
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().text != ")" {
+			return nil, fmt.Errorf("expected )")
+		}
+		p.next()
+		return n, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *exprParser) parseCmp() (exprNode, error) {
+	left, err := p.parseBitand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek().text
+	switch op {
+	case "==", "!=", "=~", "<", "<=", ">", ">=", "glob":
+		p.next()
+		right, err := p.parseBitand()
+		if err != nil {
+			return nil, err
+		}
+		return &cmpNode{op, left, right}, nil
+	}
+	return nil, fmt.Errorf("expected comparison operator, got %q", op)
+}
+
+func (p *exprParser) parseBitand() (valueNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "op" && p.peek().text == "&" {
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		left = &bitandNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parsePrimary() (valueNode, error) {
+	t := p.next()
+	switch t.kind {
+	case "ident":
+		if t.text == "glob" {
+			return nil, fmt.Errorf("unexpected glob")
+		}
+		a, ok := attrNames[t.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown identifier %q", t.text)
+		}
+		return &identNode{a}, nil
+	case "num":
+		n, err := strconv.ParseInt(t.text, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return &litNode{n}, nil
+	case "str":
+		if v, ok := parseTimeLiteral(t.text); ok {
+			return &litNode{v}, nil
+		}
+		return &litNode{t.text}, nil
+	}
+	return nil, fmt.Errorf("unexpected token %q", t.text)
+}
+
+// parseTimeLiteral tries to interpret s as an RFC3339 or YYYY-MM-DD
+// timestamp, returning ok=false if it isn't one so plain strings keep
+// working with ==, !=, =~ and glob.
+func parseTimeLiteral(s string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// exprMaxDepth conservatively reports the largest depth an expression's
+// top-level (AND-joined) clauses allow, so the walker can short-circuit
+// fs.SkipDir once no descendant could possibly satisfy it. ok is false if
+// no such bound can be proven.
+func exprMaxDepth(n exprNode) (max int64, ok bool) {
+	and, isAnd := n.(*andNode)
+	if !isAnd {
+		return depthBound(n)
+	}
+	lm, lok := exprMaxDepth(and.left)
+	rm, rok := exprMaxDepth(and.right)
+	switch {
+	case lok && rok:
+		if lm < rm {
+			return lm, true
+		}
+		return rm, true
+	case lok:
+		return lm, true
+	case rok:
+		return rm, true
+	}
+	return 0, false
+}
+
+func depthBound(n exprNode) (int64, bool) {
+	c, ok := n.(*cmpNode)
+	if !ok {
+		return 0, false
+	}
+	id, ok := c.left.(*identNode)
+	if !ok || id.a != attrDepth {
+		return 0, false
+	}
+	lit, ok := c.right.(*litNode)
+	if !ok {
+		return 0, false
+	}
+	n2, ok := lit.v.(int64)
+	if !ok {
+		return 0, false
+	}
+	switch c.op {
+	case "<":
+		return n2 - 1, true
+	case "<=":
+		return n2, true
+	}
+	return 0, false
+}
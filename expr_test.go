@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/fs"
+	"testing"
+	"time"
+)
+
+// fakeFileInfo is a minimal fs.FileInfo for exercising exprNode.eval
+// without touching the real filesystem. Sys returns nil, matching entries
+// from sources with no syscall.Stat_t (e.g. archives), so U/G/M/a-derived
+// attributes are expected to error.
+type fakeFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi fakeFileInfo) Name() string       { return fi.name }
+func (fi fakeFileInfo) Size() int64        { return fi.size }
+func (fi fakeFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi fakeFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fakeFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fakeFileInfo) Sys() interface{}   { return nil }
+
+func evalExpr(t *testing.T, expr string, ctx *exprCtx) (bool, error) {
+	t.Helper()
+	n, err := parseExpr(expr)
+	if err != nil {
+		return false, err
+	}
+	return n.eval(ctx)
+}
+
+func TestParseExprComparisons(t *testing.T) {
+	ctx := &exprCtx{
+		path:  "a/b/report.txt",
+		depth: 2,
+		fi:    fakeFileInfo{name: "report.txt", size: 1024, mode: 0644},
+	}
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{"size > 100", true},
+		{"size > 10000", false},
+		{"name == \"report.txt\"", true},
+		{"name != \"report.txt\"", false},
+		{"name =~ \"^rep.*txt$\"", true},
+		{"name glob \"*.txt\"", true},
+		{"name glob \"*.csv\"", false},
+		{"depth == 2", true},
+		{"perm & 0400 == 0400", true},
+		{"perm & 0001 == 0001", false},
+		{"size > 100 && depth == 2", true},
+		{"size > 100 && depth == 9", false},
+		{"size > 100000 || name == \"report.txt\"", true},
+		{"!(size > 100000)", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.expr, func(t *testing.T) {
+			got, err := evalExpr(t, tc.expr, ctx)
+			if err != nil {
+				t.Fatalf("eval(%q): %v", tc.expr, err)
+			}
+			if got != tc.want {
+				t.Errorf("eval(%q) = %v, want %v", tc.expr, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseExprTimeLiteral(t *testing.T) {
+	ctx := &exprCtx{
+		fi: fakeFileInfo{modTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	got, err := evalExpr(t, `mtime > "2023-12-31"`, ctx)
+	if err != nil {
+		t.Fatalf("eval: %v", err)
+	}
+	if !got {
+		t.Errorf("expected mtime comparison against a date literal to hold")
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	cases := []string{
+		"size >",         // truncated comparison
+		"bogus == 1",     // unknown identifier
+		"size ==",        // missing right operand
+		"(size > 1",      // unbalanced paren
+		"size > 1 extra", // trailing garbage
+	}
+	for _, expr := range cases {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := parseExpr(expr); err == nil {
+				t.Errorf("parseExpr(%q): expected error, got nil", expr)
+			}
+		})
+	}
+}
+
+func TestParseExprTypeMismatch(t *testing.T) {
+	ctx := &exprCtx{fi: fakeFileInfo{size: 10}}
+	if _, err := evalExpr(t, `size == "10"`, ctx); err == nil {
+		t.Errorf("expected a type mismatch error comparing size to a string literal")
+	}
+}
+
+func TestParseExprStatAttrUnavailable(t *testing.T) {
+	ctx := &exprCtx{fi: fakeFileInfo{}} // Sys() returns nil
+	if _, err := evalExpr(t, `owner == "root"`, ctx); err == nil {
+		t.Errorf("expected an error evaluating owner without a syscall.Stat_t")
+	}
+}
+
+func TestExprMaxDepth(t *testing.T) {
+	cases := []struct {
+		expr    string
+		wantOK  bool
+		wantMax int64
+	}{
+		{"depth < 3", true, 2},
+		{"depth <= 3", true, 3},
+		{"depth <= 3 && name == \"x\"", true, 3},
+		{"name == \"x\"", false, 0},
+		{"depth < 3 || name == \"x\"", false, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.expr, func(t *testing.T) {
+			n, err := parseExpr(tc.expr)
+			if err != nil {
+				t.Fatalf("parseExpr(%q): %v", tc.expr, err)
+			}
+			max, ok := exprMaxDepth(n)
+			if ok != tc.wantOK {
+				t.Fatalf("exprMaxDepth(%q) ok = %v, want %v", tc.expr, ok, tc.wantOK)
+			}
+			if ok && max != tc.wantMax {
+				t.Errorf("exprMaxDepth(%q) = %d, want %d", tc.expr, max, tc.wantMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Formatter renders a single walked entry as the text of one output line.
+// textFormatter (the default, driven by -e), mtreeFormatter (-manifest)
+// and jsonFormatter (-json/-jsonl) all implement it. depth is the entry's
+// depth relative to the walk root, as used by the json formatter's depth
+// field; the other formatters ignore it.
+type Formatter interface {
+	Format(path string, fi fs.FileInfo, depth int) (string, error)
+}
+
+// output is the active Formatter; printPath renders through it. It
+// defaults to the -e text format and is switched by -manifest/-json/-jsonl
+// in main.
+var output Formatter = textFormatter{}
+
+// textFormatter implements the -e format string: U, G, M, a, m, n, p, s
+// and x format characters separated by spaces, everything else copied
+// through verbatim.
+type textFormatter struct{}
+
+func (textFormatter) Format(path string, fi fs.FileInfo, depth int) (string, error) {
+	var sb strings.Builder
+	for i, r := range *statfmt {
+		switch r {
+		case 'U', 'G', 'M', 'a':
+			stat, ok := fi.Sys().(*syscall.Stat_t)
+			if !ok {
+				continue
+			}
+			u, err := cachedUser(fmt.Sprint(stat.Uid))
+			if err != nil {
+				return "", err
+			}
+			switch r {
+			case 'U':
+				sb.WriteString(u.Username)
+			case 'G':
+				g, err := cachedGroup(u.Gid)
+				if err != nil {
+					return "", err
+				}
+				sb.WriteString(g.Name)
+			case 'M':
+				sb.WriteString(u.Name)
+			case 'a':
+				fmt.Fprint(&sb, time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec)).Unix())
+			}
+		case 'm':
+			fmt.Fprint(&sb, fi.ModTime().Unix())
+		case 'n':
+			sb.WriteString(fi.Name())
+		case 's':
+			fmt.Fprint(&sb, fi.Size())
+		case 'p':
+			sb.WriteString(path)
+		case 'x':
+			sb.WriteString(fi.Mode().Perm().String())
+		case 't':
+			sb.WriteString(typeChar(fi))
+		case 'l':
+			if fi.Mode()&fs.ModeSymlink != 0 && fsRootDir != "" {
+				if target, err := os.Readlink(osPath(path)); err == nil {
+					sb.WriteString(target)
+				}
+			}
+		default:
+			sb.WriteRune(r)
+		}
+		if i+1 < len(*statfmt) {
+			sb.WriteByte(' ')
+		}
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fsRootDir is the directory argument of a "dir:" -fs spec, used to
+// resolve symlink targets for the json formatter's target field. It is
+// empty for zip/tar sources, where symlinks aren't resolvable this way.
+var fsRootDir string
+
+// osFS walks real OS paths directly through the os package, without the
+// restrictions os.DirFS imposes on names (no absolute paths, no ".."
+// elements). It backs the dir scheme when -fs wasn't given explicitly, so
+// a root argument like "/var/log" or "../sibling" keeps working exactly as
+// it did before walking was routed through fs.FS.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error)          { return os.Open(name) }
+func (osFS) Stat(name string) (fs.FileInfo, error)      { return os.Stat(name) }
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+// osPath turns a walked path back into a real OS path for calls (like
+// os.Readlink) that bypass fsys, joining it onto fsRootDir the way the
+// sandboxed dir scheme expects. An already-absolute path (only possible
+// when -fs wasn't given, so root arguments are plain OS paths) is used
+// as-is: joining it onto fsRootDir, "." by default, would otherwise strip
+// its leading slash instead of leaving it alone.
+func osPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(fsRootDir, path)
+}
+
+// openFS builds the fs.FS named by an -fs spec of the form "scheme:arg".
+// Supported schemes are dir (the default, arg is a directory and defaults
+// to "."), zip (arg is a .zip file) and tar (arg is a .tar file,
+// transparently gunzipped when it ends in .gz or .tgz). explicit is
+// whether -fs was actually given on the command line, as opposed to
+// falling back to its default value: the dir scheme behaves differently
+// in that case, see osFS.
+func openFS(spec string, explicit bool) (fs.FS, error) {
+	scheme, arg, ok := strings.Cut(spec, ":")
+	if !ok {
+		scheme, arg = "dir", spec
+	}
+	switch scheme {
+	case "dir":
+		if arg == "" {
+			arg = "."
+		}
+		fsRootDir = arg
+		if !explicit {
+			// No -fs given: keep the pre-fs.FS behaviour of walking real
+			// OS paths exactly as filepath.Walk did, rather than
+			// sandboxing name arguments to paths within arg the way an
+			// explicit -fs dir:path does.
+			return osFS{}, nil
+		}
+		return os.DirFS(arg), nil
+	case "zip":
+		r, err := zip.OpenReader(arg)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case "tar":
+		return openTarFS(arg)
+	default:
+		return nil, fmt.Errorf("-fs: unknown scheme %q (want dir, zip or tar)", scheme)
+	}
+}
+
+func openTarFS(name string) (fs.FS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return buildTarFS(tar.NewReader(r))
+}
+
+// tarNode is one file or directory of an in-memory tree built from a tar
+// archive, since archive/tar (unlike archive/zip) has no fs.FS of its own.
+// It implements fs.FileInfo and fs.DirEntry directly; uid/gid/atime are
+// not carried over since tar headers don't map onto syscall.Stat_t, so
+// Sys returns nil and the U/G/M/a format characters are skipped.
+type tarNode struct {
+	name     string
+	dir      bool
+	mode     fs.FileMode
+	size     int64
+	modTime  time.Time
+	data     []byte
+	children map[string]*tarNode
+}
+
+func (n *tarNode) Name() string       { return n.name }
+func (n *tarNode) Size() int64        { return n.size }
+func (n *tarNode) ModTime() time.Time { return n.modTime }
+func (n *tarNode) IsDir() bool        { return n.dir }
+func (n *tarNode) Sys() interface{}   { return nil }
+
+func (n *tarNode) Mode() fs.FileMode {
+	if n.dir {
+		return n.mode | fs.ModeDir
+	}
+	return n.mode
+}
+
+func buildTarFS(tr *tar.Reader) (fs.FS, error) {
+	root := &tarNode{name: ".", dir: true, mode: 0755, children: map[string]*tarNode{}}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		insertTarEntry(root, hdr, data)
+	}
+	return &tarFS{root: root}, nil
+}
+
+func insertTarEntry(root *tarNode, hdr *tar.Header, data []byte) {
+	clean := path.Clean(strings.Trim(hdr.Name, "/"))
+	if clean == "." || clean == "" {
+		return
+	}
+	parts := strings.Split(clean, "/")
+	cur := root
+	for i, part := range parts {
+		child, ok := cur.children[part]
+		if !ok {
+			child = &tarNode{name: part, children: map[string]*tarNode{}}
+			cur.children[part] = child
+		}
+		if i == len(parts)-1 && hdr.Typeflag != tar.TypeDir {
+			child.mode = fs.FileMode(hdr.Mode).Perm()
+			child.size = hdr.Size
+			child.modTime = hdr.ModTime
+			child.data = data
+		} else {
+			child.dir = true
+			if child.mode == 0 {
+				child.mode = fs.FileMode(hdr.Mode).Perm()
+			}
+		}
+		cur = child
+	}
+}
+
+// tarFS implements fs.FS (and, via tarDir, fs.ReadDirFile) over the tree
+// built by buildTarFS.
+type tarFS struct{ root *tarNode }
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	n := t.root
+	if name != "." {
+		for _, part := range strings.Split(name, "/") {
+			next, ok := n.children[part]
+			if !ok {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			n = next
+		}
+	}
+	if n.dir {
+		return &tarDir{node: n}, nil
+	}
+	return &tarFile{node: n}, nil
+}
+
+type tarFile struct {
+	node *tarNode
+	pos  int
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.node, nil }
+func (f *tarFile) Close() error               { return nil }
+
+func (f *tarFile) Read(b []byte) (int, error) {
+	if f.pos >= len(f.node.data) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.node.data[f.pos:])
+	f.pos += n
+	return n, nil
+}
+
+type tarDir struct {
+	node *tarNode
+	pos  int
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.node, nil }
+func (d *tarDir) Close() error               { return nil }
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.name, Err: fmt.Errorf("is a directory")}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	names := make([]string, 0, len(d.node.children))
+	for name := range d.node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if d.pos >= len(names) {
+		if n > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	remaining := names[d.pos:]
+	if n > 0 && n < len(remaining) {
+		remaining = remaining[:n]
+	}
+	entries := make([]fs.DirEntry, len(remaining))
+	for i, name := range remaining {
+		entries[i] = fs.FileInfoToDirEntry(d.node.children[name])
+	}
+	d.pos += len(remaining)
+	return entries, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+)
+
+// jsonEntry is the canonical record emitted by -json/-jsonl: every
+// attribute reachable via -e plus the fields that make walk output
+// composable with jq, fx and log-ingestion pipelines.
+type jsonEntry struct {
+	Path      string `json:"path"`
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Mode      string `json:"mode"`
+	Perm      string `json:"perm"`
+	IsDir     bool   `json:"is_dir"`
+	IsSymlink bool   `json:"is_symlink"`
+	UID       *int   `json:"uid,omitempty"`
+	GID       *int   `json:"gid,omitempty"`
+	User      string `json:"user,omitempty"`
+	Group     string `json:"group,omitempty"`
+	MTime     string `json:"mtime"`
+	ATime     string `json:"atime,omitempty"`
+	CTime     string `json:"ctime,omitempty"`
+	Depth     int    `json:"depth"`
+	Target    string `json:"target,omitempty"`
+}
+
+// jsonFormatter implements -json (pretty) and -jsonl (one object per
+// line); pretty selects which.
+type jsonFormatter struct{ pretty bool }
+
+func (f jsonFormatter) Format(path string, fi fs.FileInfo, depth int) (string, error) {
+	e := jsonEntry{
+		Path:      path,
+		Name:      fi.Name(),
+		Size:      fi.Size(),
+		Mode:      fi.Mode().String(),
+		Perm:      fi.Mode().Perm().String(),
+		IsDir:     fi.IsDir(),
+		IsSymlink: fi.Mode()&fs.ModeSymlink != 0,
+		MTime:     fi.ModTime().UTC().Format(time.RFC3339),
+		Depth:     depth,
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		uid, gid := int(stat.Uid), int(stat.Gid)
+		e.UID, e.GID = &uid, &gid
+		if u, err := cachedUser(fmt.Sprint(stat.Uid)); err == nil {
+			e.User = u.Username
+		}
+		if g, err := cachedGroup(fmt.Sprint(stat.Gid)); err == nil {
+			e.Group = g.Name
+		}
+		e.ATime = time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec)).UTC().Format(time.RFC3339)
+		e.CTime = time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec)).UTC().Format(time.RFC3339)
+	}
+	if e.IsSymlink && fsRootDir != "" {
+		if target, err := os.Readlink(osPath(path)); err == nil {
+			e.Target = target
+		}
+	}
+	var (
+		b   []byte
+		err error
+	)
+	if f.pretty {
+		b, err = json.MarshalIndent(e, "", "  ")
+	} else {
+		b, err = json.Marshal(e)
+	}
+	return string(b), err
+}
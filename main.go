@@ -6,13 +6,12 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
-	"os/exec"
-	"os/user"
-	"path/filepath"
+	"path"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
-	"syscall"
-	"time"
+	"sync"
 )
 
 var (
@@ -20,15 +19,30 @@ var (
 	isfile      = flag.Bool("f", false, "Print only non-directories.")
 	executable  = flag.Bool("x", false, "Print only if the executable bit is set.")
 	rangefmt    = flag.String("n", "", "Sets the inclusive range for depth filtering.\nThe expected format is \"min,max\" and both are optional.\nAn argument of n with no comma is equivalent to 0,n.")
-	statfmt     = flag.String("e", "p", "Specifies the output format.\nThe attributes are automatically separated with a space.\nThe following characters are accepted:\nU\tOwner name\nG\tGroup name\nM\tname of the last user to modify the file\na\tlast access time\nm\tlast modification time\nn\tfinal path element (name)\np\tpath\ns\tsize (bytes)\nx\tpermissions")
+	statfmt     = flag.String("e", "p", "Specifies the output format.\nThe attributes are automatically separated with a space.\nThe following characters are accepted:\nU\tOwner name\nG\tGroup name\nM\tname of the last user to modify the file\na\tlast access time\nm\tlast modification time\nn\tfinal path element (name)\np\tpath\ns\tsize (bytes)\nx\tpermissions\nt\tfile type (f, d, l, p, s, b or c)\nl\tresolved symlink target, empty for non-symlinks")
+	exprfmt     = flag.String("expr", "", "Filters entries with a boolean expression over file attributes,\ne.g. size>4096 && name=~\"\\\\.go$\" && perm&0111 != 0.\nIdentifiers are the same attributes accepted by -e (U, G, M, a,\nm, n, p, s, x) plus depth and type, and may also be spelled out\n(size, name, mtime, ...). Supports ==, !=, =~, glob, <, <=, >, >=,\n&&, ||, ! and parens; mtime/atime literals parse as RFC3339 or\nYYYY-MM-DD.")
+	jobs        = flag.Int("j", runtime.NumCPU(), "Sets the number of goroutines used to fan out directory reads and,\nin ! cmd mode, parallel subshell executions. Defaults to the\nnumber of logical CPUs.")
+	sorted      = flag.Bool("sort", false, "Sorts output by path before printing.\nBy default entries are printed in arrival order, which favors\nthroughput on large trees where directory-read parallelism\ndominates; -sort buffers a whole walk and prints it\ndeterministically instead.")
+	manifest    = flag.Bool("manifest", false, "Emits an mtree(5)-style manifest instead of the -e format, with\ntype=, size=, mode=, uid=, gid=, time= and sha256digest= keywords\nper record. This is walk's own round-trip format for -check, not a\n/set-deduplicated manifest interoperable with mtree(8) or go-mtree.")
+	checkfile   = flag.String("check", "", "Re-walks the tree and compares it against the mtree manifest\npreviously written with -manifest, reporting added, removed and\nmodified paths. Exits non-zero when drift is found.")
+	fsspec      = flag.String("fs", "dir:.", "Selects the fs.FS to walk: dir:path walks a real directory,\nzip:file.zip walks a zip archive and tar:file.tar[.gz] walks a\n(optionally gzipped) tar archive. When -fs is actually given, name\narguments are paths within that source, \".\" meaning its root; uid,\ngid and atime are unavailable on archive sources and silently\nomitted from U/G/M/a and -manifest output. Without -fs, name\narguments are plain OS paths instead (absolute or containing \"..\"\nincluded), matching pre-fs.FS behavior.")
+	jsonOut     = flag.Bool("json", false, "Emits every -e attribute plus canonical fields (name, is_dir,\nis_symlink, user, group, mtime/atime/ctime as RFC3339, depth,\ntarget) as one indented JSON object per entry.")
+	jsonlOut    = flag.Bool("jsonl", false, "Like -json but one compact object per line, for piping into jq,\nfx or a log ingestion pipeline.")
+	batchL      = flag.Int("L", 1, "In ! cmd mode, groups L matched paths into each sub shell\ninvocation instead of one per match, xargs(1)-style. Paths are\nshell-quoted and space-joined where they're substituted.")
+	batchP      = flag.Int("P", 0, "In ! cmd mode, runs up to P batches concurrently, xargs(1)-style.\nDefaults to -j, so subshells get the same parallelism as directory\nreads; pass -P 1 to force batches to run one at a time instead.")
+	subTok      = flag.String("I", "%", "Names the substitution token replaced by the (quoted,\nspace-joined) batch of matched paths in ! cmd mode. Defaults to\n%% for backwards compatibility; an unescaped occurrence of the\ntoken anywhere in cmd is replaced, not just a single %%.")
+	nulOut      = flag.Bool("0", false, "When cmd contains no occurrence of the -I token, the batch is\nwritten to the sub shell's standard input one path per line by\ndefault; -0 NUL-terminates them instead, for piping into tools\nsuch as xargs -0.")
+	follow      = flag.Bool("follow", false, "Follows symlinks to directories during traversal instead of\nleaving them as leaves (the default, matching filepath.Walk).\nEach branch tracks its own chain of (dev, ino) ancestors to detect\nthe cycles this can create without misflagging a diamond, where\ntwo branches legitimately reach the same directory; when a real\ncycle is found, walk prints a diagnostic to stderr and does not\nre-descend. Named -follow rather than find(1)'s -L/-P since those\nletters are already -L/-P for ! cmd batching above.")
 
 	cmd      string
 	mindepth = -1
 	maxdepth = -1
+	expr     exprNode
+	fsys     fs.FS
 )
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s [ -dfx ] [ -n min,max ] [ -e \"fmt\" ] [ name ... ] [ ! cmd ]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [ -dfx ] [ -n min,max ] [ -e \"fmt\" ] [ -expr \"expr\" ] [ -j N ] [ -sort ] [ -fs source ] [ -manifest | -check file.mtree | -json | -jsonl ] [ name ... ] [ ! cmd ]\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  !\tRun cmd in a sub shell with sh(1) for each match.\n  \tIf an unescaped %% occurs in the command list it will\n  \tbe replaced with the file name.\n")
 	flag.PrintDefaults()
 }
@@ -37,10 +51,21 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 	args := flag.Args()
+	if *batchP < 1 {
+		*batchP = *jobs
+	}
 	if err := parseRange(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	if *exprfmt != "" {
+		n, err := parseExpr(*exprfmt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-expr: %s\n", err)
+			os.Exit(1)
+		}
+		expr = n
+	}
 	for n, arg := range args {
 		if arg == "!" || strings.HasPrefix(arg, "!") {
 			if arg == "!" {
@@ -55,51 +80,221 @@ func main() {
 	if len(args) < 1 {
 		args = []string{"."}
 	}
+	fsExplicit := false
+	flag.Visit(func(fl *flag.Flag) {
+		if fl.Name == "fs" {
+			fsExplicit = true
+		}
+	})
+	f, err := openFS(*fsspec, fsExplicit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fsys = f
+	if *checkfile != "" {
+		drifted, err := runCheck(*checkfile, args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if drifted {
+			os.Exit(1)
+		}
+		return
+	}
+	switch {
+	case *manifest:
+		output = mtreeFormatter{}
+	case *jsonOut:
+		output = jsonFormatter{pretty: true}
+	case *jsonlOut:
+		output = jsonFormatter{pretty: false}
+	}
 	for _, arg := range args {
-		arg = filepath.Clean(arg) + string(os.PathSeparator)
-		rootdepth := strings.Count(arg, string(os.PathSeparator))
-		nomatches := true
-		if err := filepath.Walk(arg, func(path string, fi fs.FileInfo, err error) error {
-			if path == "." || path == ".." || !fi.IsDir() && *isdirectory || fi.IsDir() && *isfile {
-				return nil
-			}
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s\n", err)
-				return nil
-			}
-			mind, maxd := mindepth, maxdepth
-			if maxd < mind {
-				maxd = mind
+		if err := walkArg(path.Clean(arg)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// depthBounds resolves mindepth/maxdepth (as set by -n) into the inclusive
+// range that applies at depth, defaulting either end to depth itself when
+// unset so a bare -n doesn't exclude the level it was given at.
+func depthBounds(depth int) (mind, maxd int) {
+	mind, maxd = mindepth, maxdepth
+	if maxd < mind {
+		maxd = mind
+	}
+	if mind < 0 {
+		mind = depth
+	}
+	if maxd < 0 {
+		maxd = depth
+	}
+	return mind, maxd
+}
+
+// matchEntry applies the -d/-f/-n/-expr filters shared by the root
+// argument and every entry found while walking it. depth 0 is the root
+// argument itself.
+func matchEntry(path string, isDir bool, depth int, info func() (fs.FileInfo, error)) (bool, error) {
+	if !isDir && *isdirectory || isDir && *isfile {
+		return false, nil
+	}
+	mind, maxd := depthBounds(depth)
+	if depth < mind {
+		return false, nil
+	}
+	if depth > maxd {
+		return false, fs.SkipDir
+	}
+	if expr != nil {
+		if isDir {
+			if max, ok := exprMaxDepth(expr); ok && int64(depth) > max {
+				return false, fs.SkipDir
 			}
-			depth := strings.Count(path, string(os.PathSeparator)) + 1 - rootdepth
-			if mind < 0 {
-				mind = depth
+		}
+		fi, err := info()
+		if err != nil {
+			return false, err
+		}
+		ok, err := expr.eval(&exprCtx{path: path, fi: fi, depth: depth})
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+type matchedEntry struct {
+	path  string
+	fi    fs.FileInfo
+	depth int
+}
+
+// walkArg concurrently walks a single command-line argument, fanning
+// directory reads out across *jobs goroutines via dirWalker. Matches are
+// either printed as they arrive (the default, favoring I/O throughput) or
+// collected and sorted by path first when -sort is given; in ! cmd mode,
+// matches are grouped into batches of -L paths and run across up to -P
+// sub shells at a time, unless -sort forces batches to run sequentially
+// in path order instead.
+func walkArg(root string) error {
+	var (
+		mu        sync.Mutex
+		nomatches = true
+		results   []matchedEntry
+		batcher   *cmdBatcher
+	)
+	if cmd != "" {
+		batcher = newCmdBatcher(cmd, *subTok, *nulOut, *batchL, *batchP)
+	}
+
+	emit := func(path string, fi fs.FileInfo, depth int) error {
+		mu.Lock()
+		nomatches = false
+		mu.Unlock()
+		if *sorted {
+			mu.Lock()
+			results = append(results, matchedEntry{path, fi, depth})
+			mu.Unlock()
+			return nil
+		}
+		if batcher != nil {
+			batcher.add(path)
+			return nil
+		}
+		return printPath(path, fi, depth)
+	}
+
+	rootFi, err := fs.Stat(fsys, root)
+	if err != nil {
+		return err
+	}
+	info := func() (fs.FileInfo, error) { return rootFi, nil }
+	if ok, skip := matchEntry(root, rootFi.IsDir(), 0, info); skip == nil && ok {
+		if err := emit(root, rootFi, 0); err != nil {
+			return err
+		}
+	}
+
+	w := newDirWalker(fsys, *jobs, *follow, func(path string, d fs.DirEntry, depth int) error {
+		var fi fs.FileInfo
+		info := func() (fs.FileInfo, error) {
+			if fi == nil {
+				var err error
+				fi, err = d.Info()
+				if err != nil {
+					return nil, err
+				}
 			}
-			if maxd < 0 {
-				maxd = depth
+			return fi, nil
+		}
+		ok, err := matchEntry(path, d.IsDir(), depth, info)
+		if err != nil {
+			if err == fs.SkipDir {
+				return fs.SkipDir
 			}
-			if depth < mind {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		if fi == nil {
+			if fi, err = d.Info(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
 				return nil
 			}
-			if depth > maxd {
-				return fs.SkipDir
+		}
+		return emit(path, fi, depth)
+	})
+	if err := w.walk(root, 0, rootFi.IsDir()); err != nil {
+		return err
+	}
+	if batcher != nil {
+		batcher.flush()
+		batcher.wait()
+	}
+
+	if *sorted {
+		sort.Slice(results, func(i, j int) bool { return results[i].path < results[j].path })
+		if cmd != "" {
+			paths := make([]string, len(results))
+			for i, r := range results {
+				paths[i] = r.path
 			}
-			nomatches = false
-			if cmd != "" {
-				return runCmd(cmd, path)
+			for i := 0; i < len(paths); i += *batchL {
+				end := i + *batchL
+				if end > len(paths) {
+					end = len(paths)
+				}
+				if err := runCmd(cmd, paths[i:end], *subTok, *nulOut); err != nil {
+					return err
+				}
 			}
-			return printPath(path, fi)
-		}); err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
-		if nomatches {
-			fi, err := os.Stat(arg)
-			if err == nil {
-				printPath(arg, fi)
+		} else {
+			for _, r := range results {
+				if err := printPath(r.path, r.fi, r.depth); err != nil {
+					return err
+				}
 			}
 		}
 	}
+
+	if nomatches {
+		fi, err := fs.Stat(fsys, root)
+		if err != nil {
+			return nil
+		}
+		if cmd != "" {
+			return runCmd(cmd, []string{root}, *subTok, *nulOut)
+		}
+		return printPath(root, fi, 0)
+	}
+	return nil
 }
 
 func parseRange() error {
@@ -136,70 +331,13 @@ func parseRange() error {
 	return nil
 }
 
-func printPath(path string, fi fs.FileInfo) error {
-	for i, r := range *statfmt {
-		switch r {
-		case 'U', 'G', 'M', 'a':
-			stat, ok := fi.Sys().(*syscall.Stat_t)
-			if !ok {
-				continue
-			}
-			u, err := user.LookupId(fmt.Sprint(stat.Uid))
-			if err != nil {
-				return err
-			}
-			switch r {
-			case 'U':
-				fmt.Print(u.Username)
-			case 'G':
-				g, err := user.LookupGroupId(u.Gid)
-				if err != nil {
-					return err
-				}
-				fmt.Print(g.Name)
-			case 'M':
-				fmt.Print(u.Name)
-			case 'a':
-				fmt.Print(time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec)).Unix())
-			}
-		case 'm':
-			fmt.Print(fi.ModTime().Unix())
-		case 'n':
-			fmt.Print(fi.Name())
-		case 's':
-			fmt.Print(fi.Size())
-		case 'p':
-			fmt.Print(path)
-		case 'x':
-			fmt.Print(fi.Mode().Perm().String())
-		default:
-			fmt.Printf("%c", r)
-		}
-		if i+1 < len(*statfmt) {
-			fmt.Print(" ")
-		}
-	}
-	fmt.Print("\n")
-	return nil
-}
-
-func runCmd(args, path string) error {
-	var sb strings.Builder
-	for i, r := range args {
-		switch r {
-		case '%':
-			if i >= 1 && args[i-1] != '\\' {
-				sb.WriteString(path)
-				continue
-			}
-			fallthrough
-		default:
-			sb.WriteRune(r)
-		}
+// printPath renders path/fi through the active Formatter and writes it to
+// stdout.
+func printPath(path string, fi fs.FileInfo, depth int) error {
+	line, err := output.Format(path, fi, depth)
+	if err != nil {
+		return err
 	}
-	cmd := exec.Command("/bin/sh", "-c", sb.String())
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	fmt.Println(line)
+	return nil
 }
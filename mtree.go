@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// mtreeRecord is one record in walk's own round-trip manifest format: a
+// path plus the keyword/value pairs -manifest and -check know how to emit
+// and compare. The keywords are spelled the way mtree(5) spells them, but
+// every record carries all of them explicitly; unlike a real mtree(8) or
+// go-mtree manifest, there is no /set header defaulting common values and
+// no per-record delta against it, so this format is not interoperable with
+// either.
+// uid, gid and mtime are empty when the underlying fs.FileInfo has no
+// usable value for them (no syscall.Stat_t on archive sources, or a zero
+// ModTime such as a zip archive's synthetic root directory), and are then
+// omitted from String's output rather than printed as a garbage keyword.
+type mtreeRecord struct {
+	path   string
+	typ    string
+	size   int64
+	mode   string
+	uid    string
+	gid    string
+	mtime  string
+	sha256 string
+}
+
+func (r mtreeRecord) String() string {
+	var sb strings.Builder
+	sb.WriteString(r.path)
+	fmt.Fprintf(&sb, " type=%s size=%d mode=%s", r.typ, r.size, r.mode)
+	if r.uid != "" {
+		fmt.Fprintf(&sb, " uid=%s", r.uid)
+	}
+	if r.gid != "" {
+		fmt.Fprintf(&sb, " gid=%s", r.gid)
+	}
+	if r.mtime != "" {
+		fmt.Fprintf(&sb, " time=%s", r.mtime)
+	}
+	if r.sha256 != "" {
+		fmt.Fprintf(&sb, " sha256digest=%s", r.sha256)
+	}
+	return sb.String()
+}
+
+// mtreeFormatter renders entries as mtree(5)-style keyword/value records,
+// one fully-specified record per path (see mtreeRecord).
+type mtreeFormatter struct{}
+
+func (mtreeFormatter) Format(path string, fi fs.FileInfo, depth int) (string, error) {
+	rec, err := buildRecord(path, fi)
+	if err != nil {
+		return "", err
+	}
+	return rec.String(), nil
+}
+
+func buildRecord(path string, fi fs.FileInfo) (mtreeRecord, error) {
+	rec := mtreeRecord{
+		path: path,
+		typ:  mtreeType(fi),
+		size: fi.Size(),
+		mode: fmt.Sprintf("%04o", fi.Mode().Perm()),
+	}
+	if !fi.ModTime().IsZero() {
+		rec.mtime = strconv.FormatInt(fi.ModTime().Unix(), 10)
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		rec.uid = strconv.Itoa(int(stat.Uid))
+		rec.gid = strconv.Itoa(int(stat.Gid))
+	}
+	if fi.Mode().IsRegular() {
+		sum, err := sha256File(path)
+		if err != nil {
+			return rec, err
+		}
+		rec.sha256 = sum
+	}
+	return rec, nil
+}
+
+// mtreeType maps a file's type to the keyword values mtree(5) uses, which
+// spell types out rather than using the single letters of typeChar.
+func mtreeType(fi fs.FileInfo) string {
+	switch typeChar(fi) {
+	case "d":
+		return "dir"
+	case "l":
+		return "link"
+	case "p":
+		return "fifo"
+	case "s":
+		return "socket"
+	case "b":
+		return "block"
+	case "c":
+		return "char"
+	default:
+		return "file"
+	}
+}
+
+func sha256File(name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// parseManifest reads back the records written by mtreeFormatter. Blank
+// lines and lines starting with "#" or "/" (mtree comments and /set
+// directives) are ignored.
+func parseManifest(r io.Reader) (map[string]mtreeRecord, error) {
+	recs := make(map[string]mtreeRecord)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "/") {
+			continue
+		}
+		fields := strings.Fields(line)
+		rec := mtreeRecord{path: fields[0]}
+		for _, kv := range fields[1:] {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				continue
+			}
+			switch k {
+			case "type":
+				rec.typ = v
+			case "size":
+				rec.size, _ = strconv.ParseInt(v, 10, 64)
+			case "mode":
+				rec.mode = v
+			case "uid":
+				rec.uid = v
+			case "gid":
+				rec.gid = v
+			case "time":
+				rec.mtime = v
+			case "sha256digest":
+				rec.sha256 = v
+			}
+		}
+		recs[rec.path] = rec
+	}
+	return recs, sc.Err()
+}
+
+// runCheck re-walks args, compares the result against the manifest at
+// manifestPath and prints an added/removed/modified diff to stdout. It
+// reports drifted=true (the caller exits non-zero) whenever any
+// difference was found.
+func runCheck(manifestPath string, args []string) (drifted bool, err error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return false, err
+	}
+	prev, err := parseManifest(f)
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+
+	cur := make(map[string]mtreeRecord)
+	var mu sync.Mutex
+	for _, arg := range args {
+		if err := collectRecords(path.Clean(arg), cur, &mu); err != nil {
+			return false, err
+		}
+	}
+
+	var paths []string
+	for p := range mergeKeys(prev, cur) {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		old, hadOld := prev[p]
+		now, hasNew := cur[p]
+		switch {
+		case !hadOld:
+			fmt.Printf("+ %s\n", p)
+			drifted = true
+		case !hasNew:
+			fmt.Printf("- %s\n", p)
+			drifted = true
+		case old.size != now.size || old.mode != now.mode || old.sha256 != now.sha256:
+			fmt.Printf("M %s\n", p)
+			drifted = true
+		}
+	}
+	return drifted, nil
+}
+
+func mergeKeys(a, b map[string]mtreeRecord) map[string]struct{} {
+	keys := make(map[string]struct{}, len(a)+len(b))
+	for k := range a {
+		keys[k] = struct{}{}
+	}
+	for k := range b {
+		keys[k] = struct{}{}
+	}
+	return keys
+}
+
+// collectRecords walks root, applying the same -d/-f/-n/-expr filters as a
+// normal walk, and stores an mtree record per matched entry into dst.
+func collectRecords(root string, dst map[string]mtreeRecord, mu *sync.Mutex) error {
+	store := func(path string, fi fs.FileInfo) error {
+		rec, err := buildRecord(path, fi)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		dst[path] = rec
+		mu.Unlock()
+		return nil
+	}
+
+	rootFi, err := fs.Stat(fsys, root)
+	if err != nil {
+		return err
+	}
+	info := func() (fs.FileInfo, error) { return rootFi, nil }
+	if ok, skip := matchEntry(root, rootFi.IsDir(), 0, info); skip == nil && ok {
+		if err := store(root, rootFi); err != nil {
+			return err
+		}
+	}
+
+	w := newDirWalker(fsys, *jobs, *follow, func(path string, d fs.DirEntry, depth int) error {
+		var fi fs.FileInfo
+		info := func() (fs.FileInfo, error) {
+			if fi == nil {
+				var err error
+				fi, err = d.Info()
+				if err != nil {
+					return nil, err
+				}
+			}
+			return fi, nil
+		}
+		ok, err := matchEntry(path, d.IsDir(), depth, info)
+		if err != nil {
+			if err == fs.SkipDir {
+				return fs.SkipDir
+			}
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		if fi == nil {
+			if fi, err = d.Info(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+				return nil
+			}
+		}
+		return store(path, fi)
+	})
+	return w.walk(root, 0, rootFi.IsDir())
+}
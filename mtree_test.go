@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// writeManifest renders dst the way -manifest would: one mtreeRecord.String()
+// line per path, sorted for a deterministic file.
+func writeManifest(t *testing.T, path string, dst map[string]mtreeRecord) {
+	t.Helper()
+	var paths []string
+	for p := range dst {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var sb strings.Builder
+	for _, p := range paths {
+		sb.WriteString(dst[p].String())
+		sb.WriteByte('\n')
+	}
+	if err := os.WriteFile(path, []byte(sb.String()), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func TestManifestCheckRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "f.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	f, err := openFS("dir:"+dir, true)
+	if err != nil {
+		t.Fatalf("openFS: %v", err)
+	}
+	fsys = f
+
+	dst := make(map[string]mtreeRecord)
+	var mu sync.Mutex
+	if err := collectRecords(".", dst, &mu); err != nil {
+		t.Fatalf("collectRecords: %v", err)
+	}
+
+	manifestPath := filepath.Join(t.TempDir(), "manifest.mtree")
+	writeManifest(t, manifestPath, dst)
+
+	drifted, err := runCheck(manifestPath, []string{"."})
+	if err != nil {
+		t.Fatalf("runCheck: %v", err)
+	}
+	if drifted {
+		t.Errorf("runCheck reported drift against a manifest taken of the unmodified tree")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "sub", "f.txt"), []byte("modified content"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	stdout := captureStdout(t, func() {
+		drifted, err = runCheck(manifestPath, []string{"."})
+	})
+	if err != nil {
+		t.Fatalf("runCheck: %v", err)
+	}
+	if !drifted {
+		t.Errorf("runCheck did not report drift after the file's content changed")
+	}
+	if !strings.Contains(stdout, "M sub/f.txt") {
+		t.Errorf("runCheck output = %q, want it to report \"M sub/f.txt\"", stdout)
+	}
+}
+
+// TestArchiveRecordOmitsUnavailableKeywords covers the -fs zip source: its
+// synthetic root directory carries neither a syscall.Stat_t nor a non-zero
+// ModTime, so uid=, gid= and time= must be left out of the record rather
+// than rendered as "uid= gid=" or a garbage Unix timestamp.
+func TestArchiveRecordOmitsUnavailableKeywords(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "archive.zip")
+	buildTestZip(t, zipPath, map[string]string{"file.txt": "hi"})
+
+	f, err := openFS("zip:"+zipPath, true)
+	if err != nil {
+		t.Fatalf("openFS: %v", err)
+	}
+	fsys = f
+
+	dst := make(map[string]mtreeRecord)
+	var mu sync.Mutex
+	if err := collectRecords(".", dst, &mu); err != nil {
+		t.Fatalf("collectRecords: %v", err)
+	}
+
+	root, ok := dst["."]
+	if !ok {
+		t.Fatalf("collectRecords did not record the archive root")
+	}
+	line := root.String()
+	if strings.Contains(line, "uid=") || strings.Contains(line, "gid=") {
+		t.Errorf("archive root record %q should omit uid=/gid=, no syscall.Stat_t is available", line)
+	}
+	if strings.Contains(line, "time=") {
+		t.Errorf("archive root record %q should omit time=, its ModTime is zero", line)
+	}
+
+	file, ok := dst["file.txt"]
+	if !ok {
+		t.Fatalf("collectRecords did not record file.txt")
+	}
+	if got := file.String(); !strings.Contains(got, "sha256digest=") {
+		t.Errorf("file.txt record %q should still carry a sha256digest", got)
+	}
+}
+
+func buildTestZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("zip Create(%q): %v", name, err)
+		}
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatalf("zip Write(%q): %v", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip Close: %v", err)
+	}
+}
+
+// captureStdout runs fn with os.Stdout redirected to a pipe and returns
+// everything written to it, for asserting on runCheck's printed diff.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	orig := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	os.Stdout = w
+	fn()
+	w.Close()
+	os.Stdout = orig
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	return string(out)
+}
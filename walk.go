@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+)
+
+// visitFunc is called once per directory entry discovered by dirWalker. It
+// receives the entry's path, its fs.DirEntry (so callers can avoid a stat
+// unless they need one) and its depth relative to the walk root. Returning
+// fs.SkipDir prevents descending into path when it is a directory.
+type visitFunc func(path string, d fs.DirEntry, depth int) error
+
+// dirWalker fans directory reads out across a bounded pool of goroutines,
+// the concurrent analogue of filepath.WalkDir. Subdirectories are read as
+// soon as a worker slot is free; when the pool is saturated the caller's
+// own goroutine reads the subdirectory inline instead of blocking, which
+// keeps the goroutine count bounded without risking the deadlock a fixed
+// worker-pool-over-a-channel design has once that channel fills up.
+type dirWalker struct {
+	fsys   fs.FS
+	sem    chan struct{}
+	follow bool
+	visit  visitFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+// dirKey identifies a directory by its (dev, ino) pair, the same identity
+// a hard link or bind mount would share, so two fs.FileInfo values for the
+// "same" directory compare equal regardless of the path used to reach it.
+type dirKey = [2]uint64
+
+// newDirWalker returns a dirWalker that reads fsys, running at most
+// workers directory reads concurrently. workers < 1 behaves like 1. When
+// follow is true, symlinks to directories are descended into instead of
+// being left as leaves; each DFS branch tracks its own chain of ancestor
+// (dev, ino) pairs to guard against the cycles that makes possible.
+func newDirWalker(fsys fs.FS, workers int, follow bool, visit visitFunc) *dirWalker {
+	if workers < 1 {
+		workers = 1
+	}
+	return &dirWalker{fsys: fsys, sem: make(chan struct{}, workers), follow: follow, visit: visit}
+}
+
+// walk reads root's children (root itself is not visited) and recurses
+// into subdirectories, blocking until the whole subtree has been read. It
+// reports the first error returned by visit, if any; read errors are
+// printed to stderr and otherwise ignored, matching the previous
+// filepath.Walk-based behaviour. rootIsDir must reflect whether root is a
+// directory: when it isn't, walk is a no-op, matching filepath.Walk, which
+// never attempts to read a plain file's (nonexistent) entries.
+func (w *dirWalker) walk(root string, rootDepth int, rootIsDir bool) error {
+	if !rootIsDir {
+		return w.err
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.readDir(root, rootDepth, nil, &wg)
+	}()
+	wg.Wait()
+	return w.err
+}
+
+// readDir reads dir's entries and recurses into its subdirectories.
+// ancestors is the chain of (dev, ino) pairs from the walk root down to
+// dir's parent, used in -follow mode to tell a genuine symlink cycle
+// (descending back into one of dir's own ancestors) apart from a diamond,
+// where two different branches legitimately reach the same directory.
+func (w *dirWalker) readDir(dir string, depth int, ancestors []dirKey, wg *sync.WaitGroup) {
+	entries, err := fs.ReadDir(w.fsys, dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return
+	}
+	var dirKeyVal dirKey
+	haveDirKey := false
+	if w.follow {
+		dirKeyVal, haveDirKey = w.statKey(dir)
+	}
+	for _, d := range entries {
+		childPath := path.Join(dir, d.Name())
+		childDepth := depth + 1
+		err := w.visit(childPath, d, childDepth)
+		if err == fs.SkipDir {
+			continue
+		}
+		if err != nil {
+			w.setErr(err)
+			continue
+		}
+		descend := d.IsDir()
+		symlinkedDir := false
+		if !descend && w.follow && d.Type()&fs.ModeSymlink != 0 {
+			if fi, err := fs.Stat(w.fsys, childPath); err == nil && fi.IsDir() {
+				descend = true
+				symlinkedDir = true
+			}
+		}
+		if !descend {
+			continue
+		}
+		if symlinkedDir && w.ancestorCycle(childPath, ancestors) {
+			fmt.Fprintf(os.Stderr, "%s: symlink cycle detected, not descending\n", childPath)
+			continue
+		}
+		childAncestors := ancestors
+		if haveDirKey {
+			childAncestors = append(append(make([]dirKey, 0, len(ancestors)+1), ancestors...), dirKeyVal)
+		}
+		wg.Add(1)
+		select {
+		case w.sem <- struct{}{}:
+			go func() {
+				defer func() { <-w.sem; wg.Done() }()
+				w.readDir(childPath, childDepth, childAncestors, wg)
+			}()
+		default:
+			// Pool saturated: read inline rather than block, so the
+			// goroutine count stays bounded by len(w.sem).
+			func() {
+				defer wg.Done()
+				w.readDir(childPath, childDepth, childAncestors, wg)
+			}()
+		}
+	}
+}
+
+// ancestorCycle reports whether dir (identified by its dev/ino) is one of
+// ancestors, i.e. descending into it would re-enter a directory already on
+// this DFS branch's path from the walk root. It's only called in -follow
+// mode on symlinked directories, since a tree without followed symlinks
+// can't contain a cycle; dirs whose fs.FileInfo carries no syscall.Stat_t
+// (archive sources) can't be identified this way and are never reported as
+// cyclic. Unlike a walk-wide "ever seen" set, this does not flag a diamond
+// where two sibling branches legitimately reach the same non-ancestor
+// directory.
+func (w *dirWalker) ancestorCycle(dir string, ancestors []dirKey) bool {
+	key, ok := w.statKey(dir)
+	if !ok {
+		return false
+	}
+	for _, a := range ancestors {
+		if a == key {
+			return true
+		}
+	}
+	return false
+}
+
+// statKey returns dir's (dev, ino) identity, or ok == false if fsys can't
+// provide one (e.g. archive sources backing -fs).
+func (w *dirWalker) statKey(dir string) (dirKey, bool) {
+	fi, err := fs.Stat(w.fsys, dir)
+	if err != nil {
+		return dirKey{}, false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return dirKey{}, false
+	}
+	return dirKey{uint64(stat.Dev), uint64(stat.Ino)}, true
+}
+
+func (w *dirWalker) setErr(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+}